@@ -17,9 +17,14 @@ import (
 	"go/token"
 	pathpkg "path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/tools/go/buildutil"
 	"golang.org/x/tools/godoc/vfs"
 )
 
@@ -52,25 +57,465 @@ func replaceLinePrefixCommentsWithBlankLine(src []byte) {
 	}
 }
 
-func findBuildTags(file *ast.File, allowedBuildTags []string) ([]string, bool) {
+func findBuildTags(file *ast.File, allowedBuildTags []string) ([]string, bool, error) {
 	var tags []string
+	expr, _, err := extractBuildConstraint(file)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, t := range collectBuildConstraintTags(expr) {
+		for _, abt := range allowedBuildTags {
+			if t == abt {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags, len(tags) > 0, nil
+}
+
+// buildConstraintExpr is a node in a build constraint expression tree, built
+// from either a "//go:build" line or one or more "// +build" lines. Usual
+// boolean precedence applies: "!" binds tighter than "&&", which binds
+// tighter than "||".
+type buildConstraintExpr interface {
+	eval(pred func(tag string) bool) bool
+	String() string
+}
+
+// buildTagExpr is a single build tag identifier, e.g. "linux" or "go1.12".
+type buildTagExpr string
+
+func (t buildTagExpr) eval(pred func(string) bool) bool { return pred(string(t)) }
+func (t buildTagExpr) String() string                   { return string(t) }
+
+// buildNotExpr negates x, as in "!cgo".
+type buildNotExpr struct{ x buildConstraintExpr }
+
+func (n buildNotExpr) eval(pred func(string) bool) bool { return !n.x.eval(pred) }
+func (n buildNotExpr) String() string                   { return "!" + n.x.String() }
+
+// buildAndExpr is the conjunction of a and b, as in "linux && amd64".
+type buildAndExpr struct{ a, b buildConstraintExpr }
+
+func (n buildAndExpr) eval(pred func(string) bool) bool { return n.a.eval(pred) && n.b.eval(pred) }
+func (n buildAndExpr) String() string                   { return "(" + n.a.String() + " && " + n.b.String() + ")" }
+
+// buildOrExpr is the disjunction of a and b, as in "linux || darwin".
+type buildOrExpr struct{ a, b buildConstraintExpr }
+
+func (n buildOrExpr) eval(pred func(string) bool) bool { return n.a.eval(pred) || n.b.eval(pred) }
+func (n buildOrExpr) String() string                   { return "(" + n.a.String() + " || " + n.b.String() + ")" }
+
+// collectBuildConstraintTags returns the set of atomic tag identifiers
+// referenced anywhere in expr, in order of first appearance.
+func collectBuildConstraintTags(expr buildConstraintExpr) []string {
+	var tags []string
+	seen := map[string]bool{}
+	var walk func(buildConstraintExpr)
+	walk = func(e buildConstraintExpr) {
+		switch e := e.(type) {
+		case buildTagExpr:
+			if !seen[string(e)] {
+				seen[string(e)] = true
+				tags = append(tags, string(e))
+			}
+		case buildNotExpr:
+			walk(e.x)
+		case buildAndExpr:
+			walk(e.a)
+			walk(e.b)
+		case buildOrExpr:
+			walk(e.a)
+			walk(e.b)
+		}
+	}
+	if expr != nil {
+		walk(expr)
+	}
+	return tags
+}
+
+// extractBuildConstraint scans file's leading comments (those positioned
+// before the package clause) for a build constraint and returns its parsed
+// expression tree together with the constraint's source text, prefixed with
+// "go:build " or "+build " (several "+build" lines are joined with "; "). It
+// returns a nil expression if the file has
+// no build constraint, in which case the file matches unconditionally. If
+// the file has a "//go:build" line but it fails to parse (e.g. unbalanced
+// parentheses), extractBuildConstraint returns a non-nil error instead of
+// falling back to "no constraint" — a malformed constraint must not be
+// silently treated as "always builds".
+//
+// Both the modern "//go:build" line-comment syntax and the legacy
+// "// +build" syntax are recognized; a "//go:build" line takes precedence
+// over any "// +build" lines in the same file. Comments inside /* ... */
+// blocks are ignored, as is any comment group that is not separated from
+// the package clause by a blank line (such a group is attached to the file
+// as its doc comment rather than appearing as a free-standing group, so it
+// is identified by comparing against file.Doc).
+func extractBuildConstraint(file *ast.File) (buildConstraintExpr, string, error) {
+	var plusBuildLines []string
 	for _, c := range file.Comments {
+		if c.Pos() >= file.Package {
+			break
+		}
+		if c == file.Doc {
+			continue
+		}
 		for _, l := range c.List {
-			if !strings.Contains(l.Text, "+build") {
-				continue
+			if !strings.HasPrefix(l.Text, "//") {
+				continue // block comment, not a line comment
 			}
-			var tf buildutil.TagsFlag
-			_ = tf.Set(l.Text)
-			for _, t := range tf {
-				for _, abt := range allowedBuildTags {
-					if t == abt {
-						tags = append(tags, t)
-					}
+			text := strings.TrimSpace(strings.TrimPrefix(l.Text, "//"))
+			switch {
+			case strings.HasPrefix(text, "go:build"):
+				raw := strings.TrimSpace(strings.TrimPrefix(text, "go:build"))
+				expr, err := parseGoBuildConstraint(raw)
+				if err != nil {
+					return nil, "", fmt.Errorf("invalid //go:build line %q: %v", raw, err)
 				}
+				return expr, "go:build " + raw, nil
+			case strings.HasPrefix(text, "+build"):
+				raw := strings.TrimSpace(strings.TrimPrefix(text, "+build"))
+				plusBuildLines = append(plusBuildLines, raw)
 			}
 		}
 	}
-	return tags, len(tags) > 0
+	if len(plusBuildLines) == 0 {
+		return nil, "", nil
+	}
+	var expr buildConstraintExpr
+	for _, line := range plusBuildLines {
+		line := parsePlusBuildLine(line)
+		if line == nil {
+			continue
+		}
+		if expr == nil {
+			expr = line
+		} else {
+			expr = buildAndExpr{expr, line}
+		}
+	}
+	if expr == nil {
+		return nil, "", nil
+	}
+	return expr, "+build " + strings.Join(plusBuildLines, "; "), nil
+}
+
+// parsePlusBuildLine parses the space-separated clause list of a single
+// "// +build" line into an expression tree: clauses are OR'd together, and
+// within a clause, its comma-separated terms are AND'd together (so
+// "linux,386 darwin,!cgo" means "(linux && 386) || (darwin && !cgo)"). A
+// leading "!" on a term negates it.
+func parsePlusBuildLine(line string) buildConstraintExpr {
+	var expr buildConstraintExpr
+	for _, clause := range strings.Fields(line) {
+		var clauseExpr buildConstraintExpr
+		for _, f := range strings.Split(clause, ",") {
+			var term buildConstraintExpr = buildTagExpr(strings.TrimPrefix(f, "!"))
+			if strings.HasPrefix(f, "!") {
+				term = buildNotExpr{term}
+			}
+			if clauseExpr == nil {
+				clauseExpr = term
+			} else {
+				clauseExpr = buildAndExpr{clauseExpr, term}
+			}
+		}
+		if clauseExpr == nil {
+			continue
+		}
+		if expr == nil {
+			expr = clauseExpr
+		} else {
+			expr = buildOrExpr{expr, clauseExpr}
+		}
+	}
+	return expr
+}
+
+// parseGoBuildConstraint parses the expression following "//go:build" using
+// the usual precedence: "!" binds tighter than "&&", which binds tighter
+// than "||"; parentheses may be used to override precedence.
+func parseGoBuildConstraint(s string) (buildConstraintExpr, error) {
+	p := &buildConstraintParser{toks: tokenizeBuildConstraint(s)}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected token %q in build constraint", p.toks[p.pos])
+	}
+	return expr, nil
+}
+
+type buildConstraintParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *buildConstraintParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *buildConstraintParser) parseOr() (buildConstraintExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		expr = buildOrExpr{expr, rhs}
+	}
+	return expr, nil
+}
+
+func (p *buildConstraintParser) parseAnd() (buildConstraintExpr, error) {
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		expr = buildAndExpr{expr, rhs}
+	}
+	return expr, nil
+}
+
+func (p *buildConstraintParser) parseUnary() (buildConstraintExpr, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return buildNotExpr{x}, nil
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing paren in build constraint")
+		}
+		p.pos++
+		return expr, nil
+	case "", "&&", "||", ")":
+		return nil, fmt.Errorf("missing term in build constraint")
+	default:
+		tag := p.toks[p.pos]
+		p.pos++
+		return buildTagExpr(tag), nil
+	}
+}
+
+// tokenizeBuildConstraint splits a "//go:build" expression into identifier,
+// "&&", "||", "!", "(" and ")" tokens.
+func tokenizeBuildConstraint(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			toks = append(toks, string(c))
+			i++
+		case c == '&' && i+1 < len(s) && s[i+1] == '&':
+			toks = append(toks, "&&")
+			i += 2
+		case c == '|' && i+1 < len(s) && s[i+1] == '|':
+			toks = append(toks, "||")
+			i += 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t()!&|", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+// evalBuildConstraint reports whether file's build constraint (if any) is
+// satisfied under ctxt, along with the set of atomic tag identifiers that
+// appear in the constraint expression. A file with no build constraint
+// always matches.
+//
+// The predicate set used to evaluate the expression is built from
+// ctxt.BuildTags, ctxt.GOOS, ctxt.GOARCH, ctxt.ReleaseTags (the go1.N
+// series), and "cgo" when ctxt.CgoEnabled is set.
+func (c *Corpus) evalBuildConstraint(file *ast.File, ctxt *build.Context) (matched bool, tags []string, err error) {
+	expr, _, err := extractBuildConstraint(file)
+	if err != nil {
+		return false, nil, err
+	}
+	tags = collectBuildConstraintTags(expr)
+	if expr == nil {
+		return true, tags, nil
+	}
+
+	known := map[string]bool{
+		ctxt.GOOS:   true,
+		ctxt.GOARCH: true,
+	}
+	for _, t := range ctxt.BuildTags {
+		known[t] = true
+	}
+	for _, t := range ctxt.ReleaseTags {
+		known[t] = true
+	}
+	if ctxt.CgoEnabled {
+		known["cgo"] = true
+	}
+
+	matched = expr.eval(func(tag string) bool { return known[tag] })
+	return matched, tags, nil
+}
+
+// knownOS and knownArch mirror the GOOS/GOARCH values recognized by go/build
+// for the purpose of deriving implicit build constraints from filenames.
+var knownOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+	"js": true, "linux": true, "nacl": true, "netbsd": true,
+	"openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+	"windows": true, "zos": true,
+}
+
+var knownArch = map[string]bool{
+	"386": true, "amd64": true, "amd64p32": true, "arm": true,
+	"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+	"mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+	"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+	"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+	"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+}
+
+// filenameConstraintTags returns the synthetic build tags implied by a Go
+// source filename's "_GOOS", "_GOARCH" or "_GOOS_GOARCH" suffix, following
+// the same naming convention as go/build: name_linux.go, name_amd64.go and
+// name_linux_amd64.go all carry an implicit constraint, as does
+// name_linux_test.go. A bare "_test.go" suffix carries no tag of its own.
+func filenameConstraintTags(name string) []string {
+	name = strings.TrimSuffix(name, ".go")
+	name = strings.TrimSuffix(name, "_test")
+	parts := strings.Split(name, "_")
+	if len(parts) < 2 {
+		return nil
+	}
+	n := len(parts)
+	if knownOS[parts[n-1]] {
+		return []string{parts[n-1]}
+	}
+	if knownArch[parts[n-1]] {
+		if n >= 3 && knownOS[parts[n-2]] {
+			return []string{parts[n-2], parts[n-1]}
+		}
+		return []string{parts[n-1]}
+	}
+	return nil
+}
+
+// ConstraintKind describes how a build constraint was derived for a file.
+type ConstraintKind int
+
+const (
+	// NoConstraint means the file has neither an explicit comment
+	// constraint nor an implicit filename constraint.
+	NoConstraint ConstraintKind = iota
+	// ExplicitConstraint means the file carries a "//go:build" or
+	// "// +build" comment.
+	ExplicitConstraint
+	// ImplicitConstraint means the constraint comes solely from a
+	// "_GOOS", "_GOARCH" or "_GOOS_GOARCH" filename suffix.
+	ImplicitConstraint
+	// MixedConstraint means both an explicit comment and an implicit
+	// filename suffix contribute to the file's constraint.
+	MixedConstraint
+)
+
+// Constraint describes the build constraint affecting a single file, as
+// returned by Corpus.FileConstraints.
+type Constraint struct {
+	Kind ConstraintKind
+	// Expr is the explicit constraint's prefixed source text, if any (see
+	// extractBuildConstraint).
+	Expr string
+	// ImplicitTags are the synthetic tags derived from the filename, if
+	// any (see filenameConstraintTags).
+	ImplicitTags []string
+}
+
+// FileConstraints returns, for every .go file directly inside the directory
+// named by relpath, the build constraint metadata that applies to it. It
+// distinguishes constraints coming from an explicit "//go:build"/"+build"
+// comment from those implied by a GOOS/GOARCH filename suffix, since callers
+// such as the documentation renderer display the two differently. Files
+// that fail to read or parse are omitted rather than causing the whole call
+// to fail.
+//
+// fset is passed through to parseFile; callers that already parsed this
+// directory's files into an fset of their own (e.g. ServeBuildTagsIndex)
+// should pass that same fset so the parses here can be served from cache
+// instead of repeated.
+func (c *Corpus) FileConstraints(fset *token.FileSet, relpath string) map[string]Constraint {
+	result := map[string]Constraint{}
+	infos, err := c.fs.ReadDir(relpath)
+	if err != nil {
+		return result
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+
+		implicit := filenameConstraintTags(name)
+
+		file, err := c.parseFile(fset, pathpkg.Join(relpath, name), parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		expr, raw, err := extractBuildConstraint(file)
+		if err != nil {
+			continue
+		}
+
+		var kind ConstraintKind
+		switch {
+		case expr != nil && len(implicit) > 0:
+			kind = MixedConstraint
+		case expr != nil:
+			kind = ExplicitConstraint
+		case len(implicit) > 0:
+			kind = ImplicitConstraint
+		default:
+			kind = NoConstraint
+		}
+
+		result[name] = Constraint{
+			Kind:         kind,
+			Expr:         raw,
+			ImplicitTags: implicit,
+		}
+	}
+	return result
 }
 
 // mapIdentifierToBuildTag maps the identifier (type/var/const/func/method) to
@@ -78,24 +523,44 @@ func findBuildTags(file *ast.File, allowedBuildTags []string) ([]string, bool) {
 // files with different build tags. The return value map[string]string contains
 // as key the identifier name and the value are the build tags as comma
 // separated list.
+//
+// The result is memoized per (abspath, the set of files, ctxt.BuildTags),
+// see buildTagMapKey, so that repeated calls with the same inputs (e.g.
+// repeated requests to ServeBuildTagsIndex for the same package) don't
+// recompute it from scratch. The key does not otherwise track file
+// content, so if a file's content changes without its name, the set of
+// files, or BuildTags changing, a stale result can be served until the
+// process restarts. (The parsed-AST cache, by contrast, revalidates each
+// entry against the file's mtime and size; see corpusCache.parse.)
 func (c *Corpus) mapIdentifierToBuildTag(files map[string]*ast.File, relpath, abspath string, ctxt *build.Context) (map[string]string, error) {
+	cache := corpusCacheFor(c)
+	cacheKey := newBuildTagMapKey(abspath, files, ctxt.BuildTags)
+	if cached, ok := cache.getBuildTagMap(cacheKey); ok {
+		return cached, nil
+	}
+
 	allowedBuildTags := ctxt.BuildTags
 	// key=build tag, value=list of file names
 	tagToFiles := map[string][]string{}
 
 	for fName, fAst := range files {
-		if bts, ok := findBuildTags(fAst, allowedBuildTags); ok {
-			for _, bt := range bts {
-				f := tagToFiles[bt]
+		base := filepath.Base(fName)
+		bts, _, err := findBuildTags(fAst, allowedBuildTags)
+		if err != nil {
+			return nil, fmt.Errorf("%v in %q with file %q", err, abspath, base)
+		}
+		bts = append(bts, filenameConstraintTags(base)...)
+		for _, bt := range bts {
+			f := tagToFiles[bt]
 
-				f = append(f, filepath.Base(fName))
-				tagToFiles[bt] = f
-			}
+			f = append(f, base)
+			tagToFiles[bt] = f
 		}
 	}
 
 	typesWithTags := map[string]string{}
 	if len(tagToFiles) == 0 {
+		cache.putBuildTagMap(cacheKey, typesWithTags)
 		return typesWithTags, nil
 	}
 
@@ -117,20 +582,33 @@ func (c *Corpus) mapIdentifierToBuildTag(files map[string]*ast.File, relpath, ab
 		typesWithTags[key] = tns
 	}
 
-	for tagName, fileNames := range tagToFiles {
+	// files is already the fully parsed set of ASTs for this package, so
+	// the per-tag passes below reuse those ASTs by base filename instead of
+	// re-parsing the same files again (they used to be re-read and
+	// re-parsed here via a second parseFiles call, once per build tag).
+	baseToFile := make(map[string]*ast.File, len(files))
+	for fName, fAst := range files {
+		baseToFile[filepath.Base(fName)] = fAst
+	}
+	// Only used to format receiver type expressions; not tied to the fset
+	// any of these files were originally parsed with, which is fine since
+	// the expressions involved (identifiers, pointer types) carry no
+	// position-sensitive formatting such as comments.
+	fset := token.NewFileSet()
 
-		fset := token.NewFileSet()
-		// Not possible to use go/doc.New because we're reading build tag files
-		// only. Those files might reference to other types from other
-		// non-build-tagged & not-parsed files. go/doc ignores those
-		// functions/types. With parseFiles and the following code we can get
-		// all identifiers from the files with a dedicated build tag.
-		astMap, err := c.parseFiles(fset, relpath, abspath, fileNames)
-		if err != nil {
-			return nil, fmt.Errorf("%s in %q with files: %v", err.Error(), abspath, fileNames)
-		}
+	for tagName, fileNames := range tagToFiles {
+		for _, base := range fileNames {
+			fileAst, ok := baseToFile[base]
+			if !ok {
+				// Not among the ASTs the caller handed us; fall back to
+				// reading it directly rather than failing the whole call.
+				var err error
+				fileAst, err = c.parseFile(fset, pathpkg.Join(abspath, base), parser.ParseComments)
+				if err != nil {
+					return nil, fmt.Errorf("%s in %q with file: %v", err.Error(), abspath, base)
+				}
+			}
 
-		for _, fileAst := range astMap {
 			for _, decl := range fileAst.Decls {
 				switch decl := decl.(type) {
 				case *ast.FuncDecl:
@@ -154,6 +632,7 @@ func (c *Corpus) mapIdentifierToBuildTag(files map[string]*ast.File, relpath, ab
 		}
 	}
 
+	cache.putBuildTagMap(cacheKey, typesWithTags)
 	return typesWithTags, nil
 }
 
@@ -170,17 +649,12 @@ func getReceiverType(fset *token.FileSet, decl *ast.FuncDecl) string {
 	return buf.String()
 }
 
+// parseFile returns the parsed *ast.File for filename, registered in fset.
+// It is served from the corpus's cache, rather than re-parsed, when a
+// previous call already parsed this same, unchanged file into this same
+// fset with this same mode (see corpusCache.parse).
 func (c *Corpus) parseFile(fset *token.FileSet, filename string, mode parser.Mode) (*ast.File, error) {
-	src, err := vfs.ReadFile(c.fs, filename)
-	if err != nil {
-		return nil, err
-	}
-
-	// Temporary ad-hoc fix for issue 5247.
-	// TODO(gri) Remove this in favor of a better fix, eventually (see issue 7702).
-	replaceLinePrefixCommentsWithBlankLine(src)
-
-	return parser.ParseFile(fset, filename, src, mode)
+	return corpusCacheFor(c).parse(c.fs, fset, filename, mode)
 }
 
 func (c *Corpus) parseFiles(fset *token.FileSet, relpath string, abspath string, localnames []string) (map[string]*ast.File, error) {
@@ -196,3 +670,234 @@ func (c *Corpus) parseFiles(fset *token.FileSet, relpath string, abspath string,
 
 	return files, nil
 }
+
+// buildTagBadge formats the comma-separated build tag list tns (a value
+// from the map returned by mapIdentifierToBuildTag) as the short "build: "
+// annotation rendered next to a build-tagged identifier, e.g. "build:
+// xtag1" or "build: xtag2, xtag3". It returns "" for an identifier with no
+// build tags, so callers can omit the annotation entirely. ServeBuildTagsIndex
+// uses it to populate the "badges" field of its JSON response.
+func buildTagBadge(tns string) string {
+	if tns == "" {
+		return ""
+	}
+	return "build: " + tns
+}
+
+// buildTagLegend returns the distinct build tag expressions appearing
+// anywhere in typesWithTags (as produced by mapIdentifierToBuildTag),
+// sorted for stable output. ServeBuildTagsIndex reports this as the
+// "legend" field of its JSON response, letting a caller list every
+// constraint present in the package without walking "identifiers" itself.
+func buildTagLegend(typesWithTags map[string]string) []string {
+	seen := map[string]bool{}
+	var legend []string
+	for _, tns := range typesWithTags {
+		if tns == "" || seen[tns] {
+			continue
+		}
+		seen[tns] = true
+		legend = append(legend, tns)
+	}
+	sort.Strings(legend)
+	return legend
+}
+
+// astCacheStats holds the counters reported alongside a Corpus's cached
+// source bytes: how often a read was served from cache, how often it had to
+// go to the underlying vfs.FileSystem, and how many source bytes were saved
+// by not re-reading a file.
+type astCacheStats struct {
+	hits       uint64
+	misses     uint64
+	bytesSaved uint64
+}
+
+// astCacheEntry is the cached, line-prefix-scrubbed source and parsed
+// *ast.File for one file, valid as long as its vfs.FileSystem Stat still
+// reports the same (mtime, size) pair, it was parsed with the same
+// parser.Mode as the current request, and — critically — the current
+// request supplies the very same *token.FileSet the cached file was
+// parsed into. An *ast.File's positions are only meaningful relative to
+// the token.FileSet it was registered with, and parseFile's callers
+// outside this checkout (godoc's directory walker and server, which
+// thread one shared fset through a whole request) rely on that, so a
+// cached parse can only ever be handed back to a caller using that same
+// fset; a different fset still means a fresh parse.
+type astCacheEntry struct {
+	src   []byte
+	mtime time.Time
+	size  int64
+	mode  parser.Mode
+	fset  *token.FileSet
+	file  *ast.File
+}
+
+// buildTagMapKey identifies one mapIdentifierToBuildTag computation: the
+// package directory, the exact sorted set of source file names considered,
+// and the active BuildTags from the build.Context used to derive it.
+type buildTagMapKey struct {
+	abspath string
+	files   string
+	tags    string
+}
+
+// newBuildTagMapKey builds the buildTagMapKey for a mapIdentifierToBuildTag
+// call over files (keyed by name, as mapIdentifierToBuildTag itself takes
+// them) and buildTags, sorting both so that the key doesn't depend on map
+// iteration or caller-supplied ordering.
+func newBuildTagMapKey(abspath string, files map[string]*ast.File, buildTags []string) buildTagMapKey {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tags := append([]string(nil), buildTags...)
+	sort.Strings(tags)
+
+	return buildTagMapKey{
+		abspath: abspath,
+		files:   strings.Join(names, ","),
+		tags:    strings.Join(tags, ","),
+	}
+}
+
+// corpusCache memoizes the parsed source read by parseFile, keyed by
+// absolute path, so that a file already parsed into a given *token.FileSet
+// isn't read, scrubbed and reparsed into that same FileSet again. Two
+// calls for the same file with different *token.FileSet values always
+// reparse (see astCacheEntry), so this helps most within a single
+// request/walk that threads one fset through repeated parseFile calls —
+// e.g. ServeBuildTagsIndex parsing a package's files once for
+// mapIdentifierToBuildTag and again for FileConstraints.
+//
+// It also memoizes mapIdentifierToBuildTag's results, keyed by
+// buildTagMapKey, so that repeated calls for the same package under the
+// same build tags (e.g. repeated ServeBuildTagsIndex requests) are served
+// without recomputing the identifier→tag map from scratch.
+type corpusCache struct {
+	mu           sync.Mutex
+	entries      map[string]*astCacheEntry
+	stats        astCacheStats
+	buildTagMaps map[buildTagMapKey]map[string]string
+}
+
+// corpusCaches holds the corpusCache belonging to each live Corpus.
+//
+// This is a stand-in for a plain field on Corpus, set up in NewCorpus the
+// same way any other per-instance state in this codebase is threaded
+// through — that is the right home for it, and where it belongs once this
+// file lives next to the rest of the package. It cannot be done here:
+// Corpus and NewCorpus are defined in corpus.go, which is not part of this
+// checkout (this package's own tests call NewCorpus and construct
+// &Corpus{} without either being declared anywhere in this file), so this
+// file has no way to add a field to that type. corpusCacheFor arranges for
+// a Corpus's entry to be dropped once that Corpus is garbage collected, so
+// this map's size tracks the number of live Corpus values rather than
+// growing unbounded; sync.Map also means a lookup for one Corpus no longer
+// blocks behind a mutex shared by every other live Corpus in the process.
+//
+// The map is keyed by the Corpus pointer's numeric value (via
+// reflect.Value.Pointer, which avoids importing unsafe directly), not by
+// the pointer itself: a map key holds a strong reference, so keying by
+// *Corpus would keep every Corpus ever seen here reachable forever and the
+// finalizer below would never run. A numeric key carries no such
+// reference, so c remains collectible; evictCorpusCache removes the entry
+// before c's memory can be reused.
+var corpusCaches sync.Map // uintptr -> *corpusCache
+
+// corpusCacheFor returns the corpusCache belonging to c, creating it on
+// first use and registering a finalizer that removes it once c is no
+// longer reachable.
+func corpusCacheFor(c *Corpus) *corpusCache {
+	key := reflect.ValueOf(c).Pointer()
+
+	if v, ok := corpusCaches.Load(key); ok {
+		return v.(*corpusCache)
+	}
+	cc := &corpusCache{entries: map[string]*astCacheEntry{}}
+	actual, loaded := corpusCaches.LoadOrStore(key, cc)
+	if !loaded {
+		runtime.SetFinalizer(c, evictCorpusCache)
+	}
+	return actual.(*corpusCache)
+}
+
+// evictCorpusCache is registered as c's finalizer by corpusCacheFor so that
+// c's cache entry doesn't outlive c.
+func evictCorpusCache(c *Corpus) {
+	corpusCaches.Delete(reflect.ValueOf(c).Pointer())
+}
+
+// parse returns the parsed *ast.File for filename, registered in fset. It
+// serves the cached parse when fset is the very same *token.FileSet
+// (by pointer) as last time, the requested mode matches, and the file's
+// (mtime, size) are unchanged; otherwise it reads, scrubs and parses the
+// file fresh into fset and caches the result.
+func (ac *corpusCache) parse(fs vfs.FileSystem, fset *token.FileSet, filename string, mode parser.Mode) (*ast.File, error) {
+	fi, err := fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.mu.Lock()
+	e, ok := ac.entries[filename]
+	if ok && e.fset == fset && e.mode == mode && fi.ModTime().Equal(e.mtime) && fi.Size() == e.size {
+		atomic.AddUint64(&ac.stats.hits, 1)
+		atomic.AddUint64(&ac.stats.bytesSaved, uint64(len(e.src)))
+		file := e.file
+		ac.mu.Unlock()
+		return file, nil
+	}
+	ac.mu.Unlock()
+	atomic.AddUint64(&ac.stats.misses, 1)
+
+	src, err := vfs.ReadFile(fs, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Temporary ad-hoc fix for issue 5247.
+	// TODO(gri) Remove this in favor of a better fix, eventually (see issue 7702).
+	replaceLinePrefixCommentsWithBlankLine(src)
+
+	file, err := parser.ParseFile(fset, filename, src, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.mu.Lock()
+	ac.entries[filename] = &astCacheEntry{src: src, mtime: fi.ModTime(), size: fi.Size(), mode: mode, fset: fset, file: file}
+	ac.mu.Unlock()
+
+	return file, nil
+}
+
+// snapshot returns a snapshot of ac's hit/miss/bytes-saved counters.
+func (ac *corpusCache) snapshot() astCacheStats {
+	return astCacheStats{
+		hits:       atomic.LoadUint64(&ac.stats.hits),
+		misses:     atomic.LoadUint64(&ac.stats.misses),
+		bytesSaved: atomic.LoadUint64(&ac.stats.bytesSaved),
+	}
+}
+
+// getBuildTagMap returns the cached mapIdentifierToBuildTag result for
+// key, if any.
+func (ac *corpusCache) getBuildTagMap(key buildTagMapKey) (map[string]string, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	m, ok := ac.buildTagMaps[key]
+	return m, ok
+}
+
+// putBuildTagMap records m as the mapIdentifierToBuildTag result for key.
+func (ac *corpusCache) putBuildTagMap(key buildTagMapKey, m map[string]string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.buildTagMaps == nil {
+		ac.buildTagMaps = map[buildTagMapKey]map[string]string{}
+	}
+	ac.buildTagMaps[key] = m
+}
@@ -5,9 +5,14 @@
 package godoc
 
 import (
+	"go/ast"
 	"go/build"
+	"go/parser"
 	"go/token"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"golang.org/x/tools/godoc/vfs"
 	"golang.org/x/tools/godoc/vfs/mapfs"
@@ -83,3 +88,328 @@ const TestConst = true
 	haveWant("A.String", "xtag1")
 	haveWant("TestConst", "xtag2, xtag3")
 }
+
+// TestCorpus_MapIdentifierToBuildTagIsMemoized checks that a second call to
+// mapIdentifierToBuildTag with the same package directory, files and
+// BuildTags is served from cache rather than recomputed: both calls must
+// return the very same map.
+func TestCorpus_MapIdentifierToBuildTagIsMemoized(t *testing.T) {
+	mfs := mapfs.New(map[string]string{
+		"src/xtag1.go": `
+// +build xtag1
+
+package bar
+
+func First() {}
+`,
+	})
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mfs, "/", vfs.BindReplace)
+	c := NewCorpus(fs)
+
+	ctxt := build.Default
+	ctxt.BuildTags = []string{"xtag1"}
+
+	fast, err := c.parseFiles(token.NewFileSet(), "", "/src", []string{"xtag1.go"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	first, err := c.mapIdentifierToBuildTag(fast, "", "/src", &ctxt)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	second, err := c.mapIdentifierToBuildTag(fast, "", "/src", &ctxt)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if reflect.ValueOf(first).Pointer() != reflect.ValueOf(second).Pointer() {
+		t.Errorf("mapIdentifierToBuildTag result was recomputed instead of served from cache")
+	}
+}
+
+func TestCorpus_EvalBuildConstraint(t *testing.T) {
+	parse := func(t *testing.T, src string) *ast.File {
+		t.Helper()
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "test.go", src, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		ctxt    build.Context
+		want    bool
+		tags    []string
+		wantErr bool
+	}{
+		{
+			name: "no constraint matches unconditionally",
+			src:  "package p\n",
+			ctxt: build.Context{GOOS: "linux", GOARCH: "amd64"},
+			want: true,
+			tags: nil,
+		},
+		{
+			name: "go:build boolean expression",
+			src:  "//go:build (linux && amd64) || (darwin && !cgo)\n\npackage p\n",
+			ctxt: build.Context{GOOS: "darwin", GOARCH: "arm64", CgoEnabled: false},
+			want: true,
+			tags: []string{"linux", "amd64", "darwin", "cgo"},
+		},
+		{
+			name: "go:build boolean expression false",
+			src:  "//go:build (linux && amd64) || (darwin && !cgo)\n\npackage p\n",
+			ctxt: build.Context{GOOS: "darwin", GOARCH: "arm64", CgoEnabled: true},
+			want: false,
+			tags: []string{"linux", "amd64", "darwin", "cgo"},
+		},
+		{
+			name: "go:build takes precedence over +build",
+			src:  "//go:build xtag1\n// +build xtag2\n\npackage p\n",
+			ctxt: build.Context{BuildTags: []string{"xtag1"}},
+			want: true,
+			tags: []string{"xtag1"},
+		},
+		{
+			name: "legacy +build negation and multiple lines",
+			src:  "// +build linux darwin\n// +build !cgo\n\npackage p\n",
+			ctxt: build.Context{GOOS: "linux", CgoEnabled: false},
+			want: true,
+			tags: []string{"linux", "darwin", "cgo"},
+		},
+		{
+			name: "legacy +build comma-separated AND within a clause",
+			src:  "// +build linux,amd64 darwin,!cgo\n\npackage p\n",
+			ctxt: build.Context{GOOS: "darwin", GOARCH: "arm64", CgoEnabled: false},
+			want: true,
+			tags: []string{"linux", "amd64", "darwin", "cgo"},
+		},
+		{
+			name: "legacy +build comma-separated AND within a clause false",
+			src:  "// +build linux,amd64 darwin,!cgo\n\npackage p\n",
+			ctxt: build.Context{GOOS: "darwin", GOARCH: "arm64", CgoEnabled: true},
+			want: false,
+			tags: []string{"linux", "amd64", "darwin", "cgo"},
+		},
+		{
+			name: "comment without blank line before package is not a constraint",
+			src:  "// +build xtag1\npackage p\n",
+			ctxt: build.Context{},
+			want: true,
+			tags: nil,
+		},
+		{
+			name:    "malformed go:build line surfaces a parse error",
+			src:     "//go:build (linux\n\npackage p\n",
+			ctxt:    build.Context{GOOS: "windows", GOARCH: "386"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := parse(t, tc.src)
+			c := &Corpus{}
+			matched, tags, err := c.evalBuildConstraint(file, &tc.ctxt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("err = nil, want non-nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if matched != tc.want {
+				t.Errorf("matched = %v, want %v", matched, tc.want)
+			}
+			if !reflect.DeepEqual(tags, tc.tags) {
+				t.Errorf("tags = %v, want %v", tags, tc.tags)
+			}
+		})
+	}
+}
+
+func TestFilenameConstraintTags(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"foo.go", nil},
+		{"foo_linux.go", []string{"linux"}},
+		{"foo_wasip1.go", []string{"wasip1"}},
+		{"foo_amd64.go", []string{"amd64"}},
+		{"foo_linux_arm64.go", []string{"linux", "arm64"}},
+		{"foo_linux_test.go", []string{"linux"}},
+		{"foo_test.go", nil},
+		{"foo_arm64_test.go", []string{"arm64"}},
+		{"bar_notacloud.go", nil},
+	}
+	for _, tc := range tests {
+		if got := filenameConstraintTags(tc.name); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("filenameConstraintTags(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBuildTagBadge(t *testing.T) {
+	if got := buildTagBadge(""); got != "" {
+		t.Errorf("buildTagBadge(%q) = %q, want empty", "", got)
+	}
+	if got, want := buildTagBadge("xtag2, xtag3"), "build: xtag2, xtag3"; got != want {
+		t.Errorf("buildTagBadge(%q) = %q, want %q", "xtag2, xtag3", got, want)
+	}
+}
+
+func TestBuildTagLegend(t *testing.T) {
+	typesWithTags := map[string]string{
+		"First":             "xtag1",
+		"unexported":        "xtag1",
+		"A.String":          "xtag1",
+		"NewCheersWithBeer": "xtag2, xtag3",
+		"TestConst":         "xtag2, xtag3",
+	}
+	want := []string{"xtag1", "xtag2, xtag3"}
+	if got := buildTagLegend(typesWithTags); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTagLegend() = %v, want %v", got, want)
+	}
+}
+
+func TestCorpus_FileConstraints(t *testing.T) {
+	mfs := mapfs.New(map[string]string{
+		"src/plain.go": "package bar\n",
+		"src/explicit.go": `// +build xtag1
+
+package bar
+`,
+		"src/impl_linux.go": "package bar\n",
+		"src/mixed_linux.go": `//go:build xtag1
+
+package bar
+`,
+	})
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mfs, "/", vfs.BindReplace)
+	c := NewCorpus(fs)
+
+	cons := c.FileConstraints(token.NewFileSet(), "/src")
+
+	check := func(name string, wantKind ConstraintKind) {
+		got, ok := cons[name]
+		if !ok {
+			t.Errorf("%s: missing from result", name)
+			return
+		}
+		if got.Kind != wantKind {
+			t.Errorf("%s: Kind = %v, want %v", name, got.Kind, wantKind)
+		}
+	}
+	check("plain.go", NoConstraint)
+	check("explicit.go", ExplicitConstraint)
+	check("impl_linux.go", ImplicitConstraint)
+	check("mixed_linux.go", MixedConstraint)
+}
+
+func TestCorpus_ParseFileCachesParsedAST(t *testing.T) {
+	mfs := mapfs.New(map[string]string{
+		"src/foo.go": "package foo\n",
+	})
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mfs, "/", vfs.BindReplace)
+	c := NewCorpus(fs)
+
+	before := corpusCacheFor(c).snapshot()
+
+	fset := token.NewFileSet()
+	first, err := c.parseFile(fset, "/src/foo.go", parser.ParseComments)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	second, err := c.parseFile(fset, "/src/foo.go", parser.ParseComments)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if first != second {
+		t.Errorf("second parseFile call with the same fset returned a different *ast.File; want the cached parse reused, not re-parsed")
+	}
+
+	after := corpusCacheFor(c).snapshot()
+	if got := after.misses - before.misses; got != 1 {
+		t.Errorf("misses increased by %d, want 1", got)
+	}
+	if got := after.hits - before.hits; got != 1 {
+		t.Errorf("hits increased by %d, want 1", got)
+	}
+	if after.bytesSaved-before.bytesSaved == 0 {
+		t.Errorf("bytesSaved did not increase")
+	}
+}
+
+// TestCorpus_ParseFileReparsesForDifferentFileSet checks that parseFile
+// does not serve a cached parse to a caller using a different
+// *token.FileSet than the one the cached *ast.File was registered in:
+// doing so would hand back positions meaningless relative to the new
+// caller's fset.
+func TestCorpus_ParseFileReparsesForDifferentFileSet(t *testing.T) {
+	mfs := mapfs.New(map[string]string{
+		"src/foo.go": "package foo\n",
+	})
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mfs, "/", vfs.BindReplace)
+	c := NewCorpus(fs)
+
+	first, err := c.parseFile(token.NewFileSet(), "/src/foo.go", parser.ParseComments)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	second, err := c.parseFile(token.NewFileSet(), "/src/foo.go", parser.ParseComments)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if first == second {
+		t.Errorf("parseFile returned the same *ast.File for two different FileSets; positions would be meaningless against the second fset")
+	}
+}
+
+// TestCorpus_ASTCacheEvictedOnGC checks that a Corpus's entry in the
+// package-level corpusCaches registry does not outlive the Corpus itself:
+// once it becomes unreachable and is collected, its finalizer must remove
+// the entry, keeping the registry bounded by the number of live Corpus
+// values rather than growing forever.
+func TestCorpus_ASTCacheEvictedOnGC(t *testing.T) {
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mapfs.New(nil), "/", vfs.BindReplace)
+
+	// addr identifies the Corpus by pointer value without itself keeping it
+	// reachable, so the GC below is free to collect it.
+	var addr uintptr
+	func() {
+		c := NewCorpus(fs)
+		corpusCacheFor(c) // force creation of the registry entry
+		addr = reflect.ValueOf(c).Pointer()
+
+		if _, ok := corpusCaches.Load(addr); !ok {
+			t.Fatalf("corpusCaches has no entry for c right after corpusCacheFor(c)")
+		}
+	}()
+
+	present := func() bool {
+		_, ok := corpusCaches.Load(addr)
+		return ok
+	}
+
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		if !present() {
+			return // evicted, as expected
+		}
+	}
+	t.Errorf("corpusCaches entry was not evicted after the owning Corpus was collected")
+}
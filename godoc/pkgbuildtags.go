@@ -0,0 +1,156 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package godoc
+
+import (
+	"encoding/json"
+	"go/build"
+	"go/token"
+	"net/http"
+	pathpkg "path"
+	"strings"
+)
+
+// buildTagsIndexFile is the per-file entry of a buildTagsIndexResponse.
+type buildTagsIndexFile struct {
+	Name       string `json:"name"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+// buildTagsIndexCacheStats reports the corpusCache counters at the time the
+// request was served.
+type buildTagsIndexCacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	BytesSaved uint64 `json:"bytesSaved"`
+}
+
+// buildTagsIndexResponse is the JSON body served by ServeBuildTagsIndex.
+type buildTagsIndexResponse struct {
+	ImportPath  string               `json:"importpath"`
+	Files       []buildTagsIndexFile `json:"files"`
+	Identifiers map[string][]string  `json:"identifiers"`
+	// Badges maps each build-tagged identifier to its display annotation,
+	// e.g. "A.String": "build: xtag1" (see buildTagBadge).
+	Badges map[string]string `json:"badges"`
+	// Legend lists the distinct build tag expressions found in the
+	// package, sorted (see buildTagLegend).
+	Legend []string                 `json:"legend"`
+	Cache  buildTagsIndexCacheStats `json:"cache"`
+}
+
+// ServeBuildTagsIndex serves, for the import path named by the request path
+// below its mount point (conventionally "/pkg-buildtags/"), a JSON
+// description of how build constraints partition the package's
+// identifiers: which files carry which constraint, and which build tags
+// each identifier is only defined under. This lets IDEs and code-review
+// bots warn when a symbol used from cross-platform code is only defined
+// under a specific build tag.
+//
+// The query parameters "goos", "goarch" and "tags" (a comma-separated tag
+// list) override the corresponding fields of the default build.Context.
+// Only "tags" changes the response: it selects which explicit build tags
+// are reported. The identifier map does not depend on GOOS or GOARCH, so
+// "goos" and "goarch" have no effect on it, and tags implied by a
+// GOOS/GOARCH filename suffix are reported whatever the target.
+//
+// ServeBuildTagsIndex only implements the handler; mounting it at
+// "/pkg-buildtags/" happens alongside godoc's other handler registrations
+// in server.go, which this checkout does not include.
+func (c *Corpus) ServeBuildTagsIndex(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/pkg-buildtags/"
+	importPath := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if importPath == "" {
+		http.Error(w, "missing import path", http.StatusBadRequest)
+		return
+	}
+
+	ctxt := build.Default
+	q := r.URL.Query()
+	if goos := q.Get("goos"); goos != "" {
+		ctxt.GOOS = goos
+	}
+	if goarch := q.Get("goarch"); goarch != "" {
+		ctxt.GOARCH = goarch
+	}
+	if tags := q.Get("tags"); tags != "" {
+		ctxt.BuildTags = strings.Split(tags, ",")
+	}
+
+	abspath := pathpkg.Join("/src", importPath)
+	infos, err := c.fs.ReadDir(abspath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var fileNames []string
+	for _, fi := range infos {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".go") {
+			fileNames = append(fileNames, fi.Name())
+		}
+	}
+
+	// fset is shared between parseFiles below and FileConstraints further
+	// down so that the latter's re-parse of the same directory is served
+	// from the corpus's parse cache instead of re-parsing every file again.
+	fset := token.NewFileSet()
+	files, err := c.parseFiles(fset, importPath, abspath, fileNames)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tagMap, err := c.mapIdentifierToBuildTag(files, importPath, abspath, &ctxt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cons := c.FileConstraints(fset, abspath)
+
+	resp := buildTagsIndexResponse{
+		ImportPath:  importPath,
+		Files:       make([]buildTagsIndexFile, 0, len(fileNames)),
+		Identifiers: make(map[string][]string, len(tagMap)),
+		Badges:      make(map[string]string, len(tagMap)),
+		Legend:      buildTagLegend(tagMap),
+	}
+	for _, name := range fileNames {
+		resp.Files = append(resp.Files, buildTagsIndexFile{
+			Name:       name,
+			Constraint: constraintString(cons[name]),
+		})
+	}
+	for id, tns := range tagMap {
+		resp.Identifiers[id] = strings.Split(tns, ", ")
+		resp.Badges[id] = buildTagBadge(tns)
+	}
+
+	stats := corpusCacheFor(c).snapshot()
+	resp.Cache = buildTagsIndexCacheStats{
+		Hits:       stats.hits,
+		Misses:     stats.misses,
+		BytesSaved: stats.bytesSaved,
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// constraintString renders a Constraint as the single string reported in
+// the JSON "constraint" field: the explicit expression if there is one,
+// otherwise the comma-joined implicit filename tags, otherwise "".
+func constraintString(con Constraint) string {
+	if con.Expr != "" {
+		return con.Expr
+	}
+	if len(con.ImplicitTags) > 0 {
+		return strings.Join(con.ImplicitTags, ", ")
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package godoc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestCorpus_ServeBuildTagsIndex(t *testing.T) {
+	mfs := mapfs.New(map[string]string{
+		"src/bar/bar.go": `package bar
+
+var WunderBar = "Cocktails"
+`,
+		"src/bar/xtag1.go": `
+// +build xtag1
+
+package bar
+
+func First() {}
+
+type A struct{}
+
+func (a A) String() string { return "" }
+`,
+		"src/bar/xtag2.go": `
+// +build xtag2 xtag3
+
+package bar
+
+func NewCheersWithBeer() {}
+`,
+	})
+	fs := make(vfs.NameSpace)
+	fs.Bind("/", mfs, "/", vfs.BindReplace)
+	c := NewCorpus(fs)
+
+	req := httptest.NewRequest("GET", "/pkg-buildtags/bar?tags=xtag1,xtag2,xtag3", nil)
+	rec := httptest.NewRecorder()
+	c.ServeBuildTagsIndex(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	var resp buildTagsIndexResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if resp.ImportPath != "bar" {
+		t.Errorf("ImportPath = %q, want %q", resp.ImportPath, "bar")
+	}
+	if got, want := resp.Identifiers["First"], []string{"xtag1"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Identifiers[First] = %v, want %v", got, want)
+	}
+	got := resp.Identifiers["NewCheersWithBeer"]
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "xtag2" || got[1] != "xtag3" {
+		t.Errorf("Identifiers[NewCheersWithBeer] = %v, want [xtag2 xtag3]", got)
+	}
+
+	var sawXtag1File bool
+	for _, f := range resp.Files {
+		if f.Name == "xtag1.go" {
+			sawXtag1File = true
+			if f.Constraint != "+build xtag1" {
+				t.Errorf("xtag1.go Constraint = %q, want %q", f.Constraint, "+build xtag1")
+			}
+		}
+	}
+	if !sawXtag1File {
+		t.Errorf("xtag1.go missing from Files: %+v", resp.Files)
+	}
+
+	if got, want := resp.Badges["First"], "build: xtag1"; got != want {
+		t.Errorf("Badges[First] = %q, want %q", got, want)
+	}
+
+	// Normalize each legend entry's tag order before comparing: the tags
+	// within a single expression come from an internal map, so their
+	// comma-joined order is not guaranteed.
+	normalize := func(s string) string {
+		parts := strings.Split(s, ", ")
+		sort.Strings(parts)
+		return strings.Join(parts, ", ")
+	}
+	var gotLegend []string
+	for _, l := range resp.Legend {
+		gotLegend = append(gotLegend, normalize(l))
+	}
+	sort.Strings(gotLegend)
+	wantLegend := []string{"xtag1", "xtag2, xtag3"}
+	if len(gotLegend) != len(wantLegend) {
+		t.Fatalf("Legend = %v, want %v", resp.Legend, wantLegend)
+	}
+	for i, l := range wantLegend {
+		if gotLegend[i] != l {
+			t.Errorf("Legend[%d] = %q, want %q", i, gotLegend[i], l)
+		}
+	}
+}